@@ -0,0 +1,198 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api owns the HTTP(S) lifecycle of the local web API: the listener, the
+// middleware chain wrapped around the router, and graceful startup/shutdown. Route
+// registration itself stays with the subsystems (backend/handlers and friends) that
+// register their subrouters through the Registry interface.
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// Middleware wraps an http.Handler with additional behavior (auth, CORS, gzip, request
+// logging, panic recovery, secure headers, ...). Middlewares passed to New are applied
+// in order, outermost first.
+type Middleware func(http.Handler) http.Handler
+
+// Registry is the API's lifecycle and routing contract, as seen by the code that
+// assembles the actual routes (backend/handlers) and the subsystems it in turn hands
+// subrouters to (account/device handlers). Depending on this instead of the concrete
+// *API keeps that assembly code testable against a fake.
+type Registry interface {
+	// Router is where subsystems register routes directly, e.g. for top-level
+	// endpoints that do not go through Subrouter.
+	Router() *mux.Router
+	// Subrouter creates and returns a new subrouter mounted at prefix. Each call creates
+	// a new one; a subrouter created earlier for the same prefix is not returned.
+	Subrouter(prefix string) *mux.Router
+	// MarkReady unblocks requests held by waitHandler. Call this once backend.Start()
+	// has returned.
+	MarkReady()
+	// AddShutdownHook registers f to run when Stop is called, before the HTTP server
+	// itself starts draining.
+	AddShutdownHook(f func())
+}
+
+// Config configures how the API is served.
+type Config struct {
+	// Addr is the address to listen on, e.g. "127.0.0.1:8082". For Network "unix", it
+	// is the socket path instead.
+	Addr string
+	// Network is "tcp" if empty, or "unix" to bind a Unix domain socket instead.
+	Network string
+	// TLSCertFile/TLSKeyFile, if both set, serve HTTPS using the given certificate/key
+	// pair instead of plain HTTP. See EnsureSelfSignedCert.
+	TLSCertFile, TLSKeyFile string
+}
+
+// API owns the HTTP(S) server and router for the local web API, independent of which
+// routes end up registered on it.
+type API struct {
+	router *mux.Router
+
+	handler http.Handler
+	server  *http.Server
+
+	// ready is closed once the backend has finished starting. waitHandler holds
+	// requests until then, so the listener can start accepting connections (and the UI
+	// can start polling) immediately at boot.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+
+	log *logrus.Entry
+}
+
+// New creates an API with the given middleware chain wrapped around the router.
+func New(middlewares []Middleware, log *logrus.Entry) *API {
+	router := mux.NewRouter()
+
+	api := &API{
+		router: router,
+		ready:  make(chan struct{}),
+		log:    log,
+	}
+
+	var handler http.Handler = router
+	handler = api.waitHandler(handler)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	api.handler = handler
+
+	return api
+}
+
+// Router implements Registry.
+func (api *API) Router() *mux.Router {
+	return api.router
+}
+
+// Subrouter implements Registry.
+func (api *API) Subrouter(prefix string) *mux.Router {
+	return api.router.PathPrefix(prefix).Subrouter()
+}
+
+// MarkReady unblocks requests held by waitHandler. Call this once backend.Start() has
+// returned.
+func (api *API) MarkReady() {
+	api.readyOnce.Do(func() { close(api.ready) })
+}
+
+// waitHandler blocks each request until MarkReady has been called, so the listener can
+// accept connections immediately at boot without requests reaching half-initialized
+// backend state.
+func (api *API) waitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-api.ready
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AddShutdownHook registers f to run when Stop is called, before the HTTP server
+// itself starts draining. Used e.g. by handlers.EventHub to close websocket clients
+// that http.Server.Shutdown would otherwise wait on indefinitely.
+func (api *API) AddShutdownHook(f func()) {
+	api.shutdownMu.Lock()
+	defer api.shutdownMu.Unlock()
+	api.shutdownHooks = append(api.shutdownHooks, f)
+}
+
+// Start begins serving the API per cfg. It returns once the listener is open;
+// connections are accepted (and queued behind waitHandler) even before MarkReady. If
+// cfg requests TLS, it returns the PEM-encoded certificate being served (generating a
+// self-signed one via EnsureSelfSignedCert on first run), so the caller can pin it into
+// ConnectionData for the bundled UI to trust. It returns nil otherwise.
+func (api *API) Start(cfg Config) ([]byte, error) {
+	network := cfg.Network
+	if network == "" {
+		network = "tcp"
+	}
+	listener, err := net.Listen(network, cfg.Addr)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+
+	var certPEM []byte
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		certPEM, err = EnsureSelfSignedCert(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	api.server = &http.Server{Handler: api.handler}
+	go func() {
+		if err := api.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			api.log.WithError(err).Error("API server stopped unexpectedly")
+		}
+	}()
+	return certPEM, nil
+}
+
+// Stop runs the shutdown hooks (e.g. closing websocket clients) and then gracefully
+// shuts the HTTP server down, waiting for in-flight requests to finish or ctx to be
+// done, whichever comes first.
+func (api *API) Stop(ctx context.Context) error {
+	api.shutdownMu.Lock()
+	hooks := api.shutdownHooks
+	api.shutdownMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	if api.server == nil {
+		return nil
+	}
+	return errp.WithStack(api.server.Shutdown(ctx))
+}
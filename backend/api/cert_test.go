@@ -0,0 +1,67 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureSelfSignedCertGeneratesLoadableKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	certPEM, err := EnsureSelfSignedCert(certFile, keyFile)
+	require.NoError(t, err)
+	require.NotEmpty(t, certPEM)
+
+	_, err = tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err, "the generated pair must be loadable by the TLS listener")
+}
+
+func TestEnsureSelfSignedCertReusesExistingPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first, err := EnsureSelfSignedCert(certFile, keyFile)
+	require.NoError(t, err)
+
+	second, err := EnsureSelfSignedCert(certFile, keyFile)
+	require.NoError(t, err)
+
+	require.Equal(t, first, second, "an existing pair must be reused rather than regenerated")
+}
+
+func TestEnsureSelfSignedCertRegeneratesIfKeyMissing(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first, err := EnsureSelfSignedCert(certFile, keyFile)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(keyFile))
+
+	second, err := EnsureSelfSignedCert(certFile, keyFile)
+	require.NoError(t, err)
+	require.NotEqual(t, first, second, "a missing key file must trigger regeneration of the pair")
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apierror defines the stable, machine-readable error codes returned in the
+// JSON API's Response envelope (see backend/handlers.Response) and the error type that
+// carries them. It lives outside backend/handlers so that backend/devices/bitbox/handlers
+// can also produce these codes: backend/handlers already imports that package, so the
+// reverse import would be a cycle.
+package apierror
+
+import (
+	"net/http"
+
+	"github.com/shiftdevices/godbb/backend/config"
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// Error codes returned in Response.Code. These are stable across releases so the
+// frontend can key i18n and UI behavior off them instead of string-sniffing error
+// messages.
+const (
+	// CodeUnknown is used for errors that are not an *Error, e.g. unexpected I/O
+	// failures.
+	CodeUnknown = "unknown"
+	// CodeKeystoreNotRegistered signals that an operation requiring a keystore was
+	// attempted before one was registered.
+	CodeKeystoreNotRegistered = "keystore/not-registered"
+	// CodeConfigConflict signals that a config edit was rejected because the caller's
+	// fingerprint was stale.
+	CodeConfigConflict = "config/conflict"
+	// CodePairingExpired signals that a relay pairing QR code was confirmed after its
+	// advertised expiry.
+	CodePairingExpired = "pairing/expired"
+)
+
+// httpStatusByCode maps error codes to the HTTP status NewErrorResponse should send.
+// Codes not listed here default to http.StatusInternalServerError.
+var httpStatusByCode = map[string]int{
+	CodeKeystoreNotRegistered: http.StatusForbidden,
+	CodeConfigConflict:        http.StatusConflict,
+	CodePairingExpired:        http.StatusForbidden,
+}
+
+// Error is an error carrying a stable, machine-readable Code alongside a human-readable
+// Message, so the handlers package can populate Response.Code and choose an HTTP status
+// without parsing the error string.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// New creates an error of the given code, wrapped with a stack trace via errp so the
+// origin is still visible in logs.
+func New(code, message string) error {
+	return errp.WithStack(&Error{Code: code, Message: message})
+}
+
+// Error implements error.
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// HTTPStatus returns the HTTP status a handler should send for err, defaulting to 500
+// for codes it doesn't recognize.
+func (err *Error) HTTPStatus() int {
+	if status, ok := httpStatusByCode[err.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// As unwraps err, which may have been wrapped with errp.WithStack, looking for an
+// *Error.
+func As(err error) (*Error, bool) {
+	apiErr, ok := errp.Cause(err).(*Error)
+	return apiErr, ok
+}
+
+// WrapConfigConflict converts a config.ErrConfigConflict returned by a
+// config.Config.DoLockedAction callsite into a CodeConfigConflict *Error, so every
+// caller of DoLockedAction surfaces the same structured 409 instead of each re-deriving
+// the errp.Cause check itself. err is returned unchanged if it is nil or not a
+// config.ErrConfigConflict.
+func WrapConfigConflict(err error) error {
+	if errp.Cause(err) == config.ErrConfigConflict {
+		return New(CodeConfigConflict, "config was modified concurrently; please re-fetch and retry")
+	}
+	return err
+}
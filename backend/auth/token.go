@@ -0,0 +1,137 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth issues and validates the short-lived JWTs used to authenticate requests
+// to the local HTTP API.
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// tokenLifetime is how long an issued token remains valid before a client must call
+// /api/refresh to get a new one.
+const tokenLifetime = 24 * time.Hour
+
+// TokenService issues, validates and revokes JWTs used to authenticate API clients.
+// Tokens are signed with a secret generated once per process, so all tokens issued
+// before a backend restart become invalid.
+type TokenService struct {
+	secret []byte
+
+	mu      sync.Mutex
+	revoked map[string]time.Time // jti -> time after which the entry can be garbage collected
+}
+
+// NewTokenService creates a TokenService with a freshly generated random secret.
+func NewTokenService() (*TokenService, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return &TokenService{
+		secret:  secret,
+		revoked: map[string]time.Time{},
+	}, nil
+}
+
+// Issue creates a new JWT identifying the given subject (the client the token was
+// issued to), valid for tokenLifetime.
+func (service *TokenService) Issue(subject string) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   subject,
+		ID:        newJTI(),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(tokenLifetime)),
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(service.secret)
+	if err != nil {
+		return "", errp.WithStack(err)
+	}
+	return signed, nil
+}
+
+// Refresh validates tokenString and, if still valid, issues a new token for the same
+// subject and revokes tokenString so it cannot be reused.
+func (service *TokenService) Refresh(tokenString string) (string, error) {
+	claims, err := service.Parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+	service.Revoke(claims.ID)
+	return service.Issue(claims.Subject)
+}
+
+// Parse validates tokenString and returns its claims. It fails if the token is
+// malformed, expired, signed with an algorithm other than HS256, or was revoked.
+func (service *TokenService) Parse(tokenString string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return service.secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if service.isRevoked(claims.ID) {
+		return nil, errp.New("token has been revoked")
+	}
+	return claims, nil
+}
+
+// Revoke blacklists the token with the given jti so that it is rejected by Parse even
+// before it expires. Used to implement logging out a single client without affecting
+// tokens issued to other clients.
+func (service *TokenService) Revoke(jti string) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	service.gc()
+	service.revoked[jti] = time.Now().Add(tokenLifetime)
+}
+
+func (service *TokenService) isRevoked(jti string) bool {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	_, ok := service.revoked[jti]
+	return ok
+}
+
+// gc drops blacklist entries whose underlying token would have expired anyway, so the
+// blacklist does not grow unbounded. Callers must hold service.mu.
+func (service *TokenService) gc() {
+	now := time.Now()
+	for jti, expiry := range service.revoked {
+		if now.After(expiry) {
+			delete(service.revoked, jti)
+		}
+	}
+}
+
+func newJTI() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error on the platforms we support; a failure
+	// here would mean the OS can no longer provide randomness, in which case the jti
+	// is the least of our problems.
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
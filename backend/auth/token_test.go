@@ -0,0 +1,89 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssueAndParse(t *testing.T) {
+	service, err := NewTokenService()
+	require.NoError(t, err)
+
+	tokenString, err := service.Issue("client-1")
+	require.NoError(t, err)
+
+	claims, err := service.Parse(tokenString)
+	require.NoError(t, err)
+	require.Equal(t, "client-1", claims.Subject)
+}
+
+func TestParseRejectsExpiredToken(t *testing.T) {
+	service, err := NewTokenService()
+	require.NoError(t, err)
+
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   "client-1",
+		ID:        newJTI(),
+		IssuedAt:  jwt.NewNumericDate(now.Add(-2 * tokenLifetime)),
+		NotBefore: jwt.NewNumericDate(now.Add(-2 * tokenLifetime)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(-tokenLifetime)),
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(service.secret)
+	require.NoError(t, err)
+
+	_, err = service.Parse(expired)
+	require.Error(t, err)
+}
+
+func TestParseRejectsRevokedToken(t *testing.T) {
+	service, err := NewTokenService()
+	require.NoError(t, err)
+
+	tokenString, err := service.Issue("client-1")
+	require.NoError(t, err)
+	claims, err := service.Parse(tokenString)
+	require.NoError(t, err)
+
+	service.Revoke(claims.ID)
+
+	_, err = service.Parse(tokenString)
+	require.Error(t, err)
+}
+
+func TestRefreshIssuesNewTokenAndRevokesOld(t *testing.T) {
+	service, err := NewTokenService()
+	require.NoError(t, err)
+
+	original, err := service.Issue("client-1")
+	require.NoError(t, err)
+
+	refreshed, err := service.Refresh(original)
+	require.NoError(t, err)
+	require.NotEqual(t, original, refreshed)
+
+	_, err = service.Parse(original)
+	require.Error(t, err, "the token Refresh was called with should be revoked")
+
+	claims, err := service.Parse(refreshed)
+	require.NoError(t, err)
+	require.Equal(t, "client-1", claims.Subject)
+}
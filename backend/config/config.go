@@ -0,0 +1,172 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config persists and gives concurrency-safe access to the app-wide settings
+// editable through the UI.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// AppConfig holds all settings that are persisted to disk and editable through the UI.
+type AppConfig struct {
+	Backend  BackendConfig            `json:"backend"`
+	Pairings map[string]PairingConfig `json:"pairings,omitempty"`
+}
+
+// BackendConfig holds backend-specific settings.
+type BackendConfig struct {
+	UserLanguage string `json:"userLanguage"`
+}
+
+// PairingConfig is the persisted state of one device's mobile relay pairing, keyed by
+// device ID in AppConfig.Pairings. The authentication key is stored encrypted with a
+// per-install key derived from the OS keyring, never in plaintext.
+type PairingConfig struct {
+	ChannelID                  string `json:"channelID"`
+	EncryptionKey              []byte `json:"encryptionKey"`
+	EncryptedAuthenticationKey []byte `json:"encryptedAuthenticationKey"`
+}
+
+// ErrConfigConflict is returned by DoLockedAction when the
+// fingerprint passed by the caller does not match the config currently held in memory,
+// meaning another UI window or a paired mobile client changed it in the meantime.
+var ErrConfigConflict = errp.New("config conflict: stale fingerprint")
+
+// Config gives concurrency-safe access to the AppConfig persisted at configFile.
+type Config struct {
+	configFile string
+
+	mu     sync.Mutex
+	config AppConfig
+}
+
+// NewConfig creates a Config backed by configFile, loading any settings already
+// persisted there. A missing or corrupt file is not an error; it just means the zero
+// value AppConfig{} is used until the next Set.
+func NewConfig(configFile string) *Config {
+	config := &Config{configFile: configFile}
+	_ = config.load()
+	return config
+}
+
+func (config *Config) load() error {
+	contents, err := ioutil.ReadFile(config.configFile)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	var appConfig AppConfig
+	if err := json.Unmarshal(contents, &appConfig); err != nil {
+		return errp.WithStack(err)
+	}
+	config.config = appConfig
+	return nil
+}
+
+// Config returns a copy of the currently active AppConfig.
+func (config *Config) Config() AppConfig {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return config.config
+}
+
+// Fingerprint returns a stable hash of the currently active AppConfig, computed over
+// its canonical JSON encoding. Callers pass this back to DoLockedAction so stale
+// writes can be detected instead of silently clobbering a concurrent edit.
+func (config *Config) Fingerprint() (string, error) {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return config.fingerprint()
+}
+
+// fingerprint must be called with config.mu held.
+func (config *Config) fingerprint() (string, error) {
+	canonical, err := json.Marshal(config.config)
+	if err != nil {
+		return "", errp.WithStack(err)
+	}
+	sum := sha256.Sum256(canonical)
+	return fmt.Sprintf("%x", sum), nil
+}
+
+// Set overwrites the AppConfig unconditionally and persists it to configFile. Prefer
+// DoLockedAction for edits that must not race with a concurrent writer.
+func (config *Config) Set(appConfig AppConfig) error {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return config.set(appConfig)
+}
+
+// set must be called with config.mu held.
+func (config *Config) set(appConfig AppConfig) error {
+	contents, err := json.MarshalIndent(appConfig, "", "  ")
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if err := ioutil.WriteFile(config.configFile, contents, 0600); err != nil {
+		return errp.WithStack(err)
+	}
+	config.config = appConfig
+	return nil
+}
+
+// DoLockedAction acquires the config lock, verifies that fingerprint still matches the
+// config currently held in memory, and if so runs cb against a deep copy of the
+// config, persisting whatever cb leaves it as. It returns ErrConfigConflict without
+// calling cb if fingerprint is stale, so the caller can re-fetch and merge instead of
+// silently overwriting a concurrent edit.
+func (config *Config) DoLockedAction(fingerprint string, cb func(*AppConfig) error) error {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+
+	current, err := config.fingerprint()
+	if err != nil {
+		return err
+	}
+	if fingerprint != current {
+		return ErrConfigConflict
+	}
+
+	appConfig, err := cloneAppConfig(config.config)
+	if err != nil {
+		return err
+	}
+	if err := cb(appConfig); err != nil {
+		return err
+	}
+	return config.set(*appConfig)
+}
+
+// cloneAppConfig deep-copies appConfig so a caller can freely mutate reference-typed
+// fields (e.g. the Pairings map) without those mutations being visible on the original
+// until (and unless) Config.set persists them.
+func cloneAppConfig(appConfig AppConfig) (*AppConfig, error) {
+	contents, err := json.Marshal(appConfig)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	clone := &AppConfig{}
+	if err := json.Unmarshal(contents, clone); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return clone, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfig(t *testing.T) *Config {
+	return NewConfig(filepath.Join(t.TempDir(), "config.json"))
+}
+
+func TestDoLockedActionRejectsStaleFingerprint(t *testing.T) {
+	config := newTestConfig(t)
+
+	fingerprint, err := config.Fingerprint()
+	require.NoError(t, err)
+
+	require.NoError(t, config.Set(AppConfig{Backend: BackendConfig{UserLanguage: "en"}}))
+
+	err = config.DoLockedAction(fingerprint, func(appConfig *AppConfig) error {
+		appConfig.Backend.UserLanguage = "de"
+		return nil
+	})
+	require.ErrorIs(t, err, ErrConfigConflict)
+	require.Equal(t, "en", config.Config().Backend.UserLanguage, "a stale write must not be applied")
+}
+
+func TestDoLockedActionAppliesUnderCurrentFingerprint(t *testing.T) {
+	config := newTestConfig(t)
+
+	fingerprint, err := config.Fingerprint()
+	require.NoError(t, err)
+
+	err = config.DoLockedAction(fingerprint, func(appConfig *AppConfig) error {
+		appConfig.Backend.UserLanguage = "de"
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "de", config.Config().Backend.UserLanguage)
+}
+
+func TestDoLockedActionCallbackMutationsAreIsolatedUntilSuccess(t *testing.T) {
+	config := newTestConfig(t)
+
+	require.NoError(t, config.Set(AppConfig{
+		Pairings: map[string]PairingConfig{"device-1": {ChannelID: "original"}},
+	}))
+	fingerprint, err := config.Fingerprint()
+	require.NoError(t, err)
+	// Keep a reference to the live map so we can tell whether the callback mutated it
+	// directly (a shallow-copy bug) instead of a deep copy.
+	liveMap := config.Config().Pairings
+
+	err = config.DoLockedAction(fingerprint, func(appConfig *AppConfig) error {
+		appConfig.Pairings["device-1"] = PairingConfig{ChannelID: "mutated"}
+		require.Equal(t, "original", liveMap["device-1"].ChannelID,
+			"the callback must operate on a deep copy, not the live Pairings map")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "mutated", config.Config().Pairings["device-1"].ChannelID)
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package handlers provides the web API for a single bitbox device.
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"github.com/shiftdevices/godbb/backend/config"
+	"github.com/shiftdevices/godbb/backend/devices/bitbox"
+)
+
+// Route registers a single API endpoint relative to this device's subrouter.
+type Route func(path string, f func(*http.Request) (interface{}, error)) *mux.Route
+
+// Handlers provides a web API for a single bitbox device.
+type Handlers struct {
+	device  *bitbox.Device
+	pairing *pairingHandlers
+	log     *logrus.Entry
+}
+
+// NewHandlers creates the per-device API for a bitbox, registering its routes via
+// getAPIRouter. publish is used to emit events (e.g. pairing status changes) onto the
+// shared events websocket.
+func NewHandlers(
+	getAPIRouter Route,
+	appConfig *config.Config,
+	publish func(interface{}),
+	log *logrus.Entry,
+) *Handlers {
+	return &Handlers{
+		pairing: newPairingHandlers(getAPIRouter, appConfig, publish, log),
+		log:     log,
+	}
+}
+
+// Init is called when the device is registered.
+func (handlers *Handlers) Init(device *bitbox.Device) {
+	handlers.device = device
+	handlers.pairing.init(device.Identifier())
+}
+
+// Uninit is called when the device is deregistered.
+func (handlers *Handlers) Uninit() {
+	handlers.pairing.uninit()
+	handlers.device = nil
+}
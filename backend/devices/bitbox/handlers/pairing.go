@@ -0,0 +1,337 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zalando/go-keyring"
+
+	"github.com/shiftdevices/godbb/backend/apierror"
+	"github.com/shiftdevices/godbb/backend/config"
+	"github.com/shiftdevices/godbb/backend/devices/bitbox/relay"
+	"github.com/shiftdevices/godbb/util/errp"
+	"github.com/shiftdevices/godbb/util/qr"
+)
+
+const (
+	keyringService = "co.shiftcrypto.bitboxapp"
+	keyringAccount = "relay-pairing-key"
+
+	// pairingQRExpiry is how long the QR code returned by POST .../pairing/start is
+	// valid for before the caller should start over.
+	pairingQRExpiry = 10 * time.Minute
+)
+
+// pairingStatus is the lifecycle of a device's mobile relay pairing, reported by GET
+// .../pairing/status and streamed over the events websocket.
+type pairingStatus string
+
+const (
+	pairingUnpaired pairingStatus = "unpaired"
+	pairingAwaiting pairingStatus = "awaiting"
+	pairingPaired   pairingStatus = "paired"
+)
+
+// pairingEvent is published whenever a device's pairing status changes, so the UI can
+// react without polling GET .../pairing/status.
+type pairingEvent struct {
+	DeviceID string        `json:"deviceID"`
+	Status   pairingStatus `json:"status"`
+}
+
+// Topic lets UIs subscribe to just pairing events on the events websocket
+// (?topics=pairing).
+func (pairingEvent) Topic() string { return "pairing" }
+
+// pairingHandlers serves /pairing under a single device's subrouter, managing the
+// QR-based relay pairing handshake with a mobile client.
+type pairingHandlers struct {
+	appConfig *config.Config
+	publish   func(interface{})
+	log       *logrus.Entry
+
+	mu        sync.Mutex
+	deviceID  string
+	channel   *relay.Channel
+	status    pairingStatus
+	expiresAt time.Time
+}
+
+func newPairingHandlers(
+	getAPIRouter Route,
+	appConfig *config.Config,
+	publish func(interface{}),
+	log *logrus.Entry,
+) *pairingHandlers {
+	handlers := &pairingHandlers{
+		appConfig: appConfig,
+		publish:   publish,
+		log:       log,
+		status:    pairingUnpaired,
+	}
+	getAPIRouter("/pairing/start", handlers.postPairingStartHandler).Methods("POST")
+	getAPIRouter("/pairing/status", handlers.getPairingStatusHandler).Methods("GET")
+	getAPIRouter("/pairing/confirm", handlers.postPairingConfirmHandler).Methods("POST")
+	getAPIRouter("/pairing", handlers.deletePairingHandler).Methods("DELETE")
+	return handlers
+}
+
+// init restores a previously persisted pairing for deviceID, if any.
+func (handlers *pairingHandlers) init(deviceID string) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+
+	handlers.deviceID = deviceID
+	pairing, ok := handlers.appConfig.Config().Pairings[deviceID]
+	if !ok {
+		return
+	}
+	channel, err := decryptChannel(pairing)
+	if err != nil {
+		handlers.log.WithError(err).Error("failed to decrypt persisted pairing; treating device as unpaired")
+		return
+	}
+	handlers.channel = channel
+	handlers.status = pairingPaired
+}
+
+func (handlers *pairingHandlers) uninit() {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	handlers.deviceID = ""
+	handlers.channel = nil
+	handlers.status = pairingUnpaired
+}
+
+// postPairingStartHandler generates a fresh relay channel and returns a QR code
+// encoding the channel's ID for the mobile app to scan. The channel's encryption and
+// authentication keys are not part of the QR code. The channel is not yet considered paired
+// until postPairingConfirmHandler is called.
+func (handlers *pairingHandlers) postPairingStartHandler(_ *http.Request) (interface{}, error) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+
+	channel, err := relay.NewRandomChannel()
+	if err != nil {
+		return nil, err
+	}
+	handlers.channel = channel
+	handlers.expiresAt = time.Now().Add(pairingQRExpiry)
+	handlers.setStatusLocked(pairingAwaiting)
+
+	qrCode, err := qr.PNGDataURI(channel.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"qr":        qrCode,
+		"channel":   channel.ChannelID,
+		"expiresAt": handlers.expiresAt,
+	}, nil
+}
+
+func (handlers *pairingHandlers) getPairingStatusHandler(_ *http.Request) (interface{}, error) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+	return handlers.status, nil
+}
+
+// postPairingConfirmHandler finalizes the pairing after the mobile app has signaled,
+// out of band over the relay channel itself, that it received the channel. The channel
+// is persisted so the pairing survives an app restart.
+func (handlers *pairingHandlers) postPairingConfirmHandler(_ *http.Request) (interface{}, error) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+
+	if handlers.channel == nil || handlers.status != pairingAwaiting {
+		return nil, errp.New("no pairing in progress to confirm")
+	}
+	if time.Now().After(handlers.expiresAt) {
+		handlers.channel = nil
+		handlers.setStatusLocked(pairingUnpaired)
+		return nil, apierror.New(apierror.CodePairingExpired, "pairing QR code has expired")
+	}
+
+	pairing, err := encryptChannel(handlers.channel)
+	if err != nil {
+		return nil, err
+	}
+	if err := handlers.persistLocked(&pairing); err != nil {
+		return nil, err
+	}
+	handlers.setStatusLocked(pairingPaired)
+	return true, nil
+}
+
+// deletePairingHandler zeroes the channel's keys and revokes the pairing.
+func (handlers *pairingHandlers) deletePairingHandler(_ *http.Request) (interface{}, error) {
+	handlers.mu.Lock()
+	defer handlers.mu.Unlock()
+
+	zeroBytes(handlers.channel)
+	handlers.channel = nil
+	if err := handlers.persistLocked(nil); err != nil {
+		return nil, err
+	}
+	handlers.setStatusLocked(pairingUnpaired)
+	return true, nil
+}
+
+// persistLocked stores (or, if pairing is nil, removes) this device's pairing in the
+// app config. Callers must hold handlers.mu.
+func (handlers *pairingHandlers) persistLocked(pairing *config.PairingConfig) error {
+	fingerprint, err := handlers.appConfig.Fingerprint()
+	if err != nil {
+		return err
+	}
+	err = handlers.appConfig.DoLockedAction(fingerprint, func(appConfig *config.AppConfig) error {
+		if appConfig.Pairings == nil {
+			appConfig.Pairings = map[string]config.PairingConfig{}
+		}
+		if pairing == nil {
+			delete(appConfig.Pairings, handlers.deviceID)
+		} else {
+			appConfig.Pairings[handlers.deviceID] = *pairing
+		}
+		return nil
+	})
+	return apierror.WrapConfigConflict(err)
+}
+
+// setStatusLocked updates the status and publishes a pairingEvent. Callers must hold
+// handlers.mu.
+func (handlers *pairingHandlers) setStatusLocked(status pairingStatus) {
+	handlers.status = status
+	if handlers.publish != nil {
+		handlers.publish(pairingEvent{DeviceID: handlers.deviceID, Status: status})
+	}
+}
+
+// encryptChannel serializes channel for persistence, encrypting its authentication key
+// with the per-install key from the OS keyring so it is never at rest in plaintext.
+func encryptChannel(channel *relay.Channel) (config.PairingConfig, error) {
+	key, err := installKey()
+	if err != nil {
+		return config.PairingConfig{}, err
+	}
+	encryptedAuthKey, err := encrypt(key, channel.AuthenticationKey)
+	if err != nil {
+		return config.PairingConfig{}, err
+	}
+	return config.PairingConfig{
+		ChannelID:                  channel.ChannelID,
+		EncryptionKey:              channel.EncryptionKey,
+		EncryptedAuthenticationKey: encryptedAuthKey,
+	}, nil
+}
+
+// decryptChannel reverses encryptChannel.
+func decryptChannel(pairing config.PairingConfig) (*relay.Channel, error) {
+	key, err := installKey()
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := decrypt(key, pairing.EncryptedAuthenticationKey)
+	if err != nil {
+		return nil, err
+	}
+	return relay.NewChannel(pairing.ChannelID, pairing.EncryptionKey, authKey), nil
+}
+
+// installKey returns the per-install key used to encrypt pairing secrets at rest,
+// generating and storing a fresh one in the OS keyring the first time it is needed.
+func installKey() ([]byte, error) {
+	encoded, err := keyring.Get(keyringService, keyringAccount)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errp.WithStack(err)
+		}
+		return key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if err := keyring.Set(keyringService, keyringAccount, base64.StdEncoding.EncodeToString(key)); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return key, nil
+}
+
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errp.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return gcm, nil
+}
+
+// zeroBytes overwrites channel's key material in place before it is dropped, so it does
+// not linger in memory until the garbage collector reclaims it. A nil channel is a
+// no-op.
+func zeroBytes(channel *relay.Channel) {
+	if channel == nil {
+		return
+	}
+	for i := range channel.EncryptionKey {
+		channel.EncryptionKey[i] = 0
+	}
+	for i := range channel.AuthenticationKey {
+		channel.AuthenticationKey[i] = 0
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/zalando/go-keyring"
+
+	"github.com/shiftdevices/godbb/backend/apierror"
+	"github.com/shiftdevices/godbb/backend/config"
+	"github.com/shiftdevices/godbb/backend/devices/bitbox/relay"
+)
+
+func init() {
+	// Use an in-memory keyring instead of the OS one so these tests can run anywhere.
+	keyring.MockInit()
+}
+
+func newTestPairingHandlers(t *testing.T) *pairingHandlers {
+	router := mux.NewRouter()
+	getAPIRouter := func(path string, f func(*http.Request) (interface{}, error)) *mux.Route {
+		return router.Handle(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = f(r)
+		}))
+	}
+	appConfig := config.NewConfig(filepath.Join(t.TempDir(), "config.json"))
+	handlers := newPairingHandlers(getAPIRouter, appConfig, nil, logrus.NewEntry(logrus.New()))
+	handlers.init("device-1")
+	return handlers
+}
+
+func TestPostPairingConfirmHandlerSucceedsBeforeExpiry(t *testing.T) {
+	handlers := newTestPairingHandlers(t)
+
+	_, err := handlers.postPairingStartHandler(nil)
+	require.NoError(t, err)
+
+	_, err = handlers.postPairingConfirmHandler(nil)
+	require.NoError(t, err)
+	require.Equal(t, pairingPaired, handlers.status)
+}
+
+func TestPostPairingConfirmHandlerRejectsExpiredPairing(t *testing.T) {
+	handlers := newTestPairingHandlers(t)
+
+	_, err := handlers.postPairingStartHandler(nil)
+	require.NoError(t, err)
+	handlers.expiresAt = time.Now().Add(-time.Second)
+
+	_, err = handlers.postPairingConfirmHandler(nil)
+	require.Error(t, err)
+	apiErr, ok := apierror.As(err)
+	require.True(t, ok)
+	require.Equal(t, apierror.CodePairingExpired, apiErr.Code)
+	require.Equal(t, pairingUnpaired, handlers.status, "an expired confirm must revert to unpaired")
+	require.Nil(t, handlers.channel)
+}
+
+func TestPostPairingConfirmHandlerRejectsWithoutStart(t *testing.T) {
+	handlers := newTestPairingHandlers(t)
+
+	_, err := handlers.postPairingConfirmHandler(nil)
+	require.Error(t, err)
+}
+
+func TestDeletePairingHandlerZeroesKeysAndUnpairs(t *testing.T) {
+	handlers := newTestPairingHandlers(t)
+
+	_, err := handlers.postPairingStartHandler(nil)
+	require.NoError(t, err)
+	_, err = handlers.postPairingConfirmHandler(nil)
+	require.NoError(t, err)
+
+	channel := handlers.channel
+	encKey := channel.EncryptionKey
+	authKey := channel.AuthenticationKey
+
+	_, err = handlers.deletePairingHandler(nil)
+	require.NoError(t, err)
+
+	require.Equal(t, pairingUnpaired, handlers.status)
+	require.Nil(t, handlers.channel)
+	require.Zero(t, countNonZero(encKey), "EncryptionKey must be zeroed, not just dereferenced")
+	require.Zero(t, countNonZero(authKey), "AuthenticationKey must be zeroed, not just dereferenced")
+}
+
+func countNonZero(b []byte) int {
+	count := 0
+	for _, v := range b {
+		if v != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestEncryptDecryptChannelRoundTrip(t *testing.T) {
+	channel, err := relay.NewRandomChannel()
+	require.NoError(t, err)
+
+	pairing, err := encryptChannel(channel)
+	require.NoError(t, err)
+	require.NotEqual(t, channel.AuthenticationKey, pairing.EncryptedAuthenticationKey,
+		"the authentication key must not be persisted in plaintext")
+
+	decrypted, err := decryptChannel(pairing)
+	require.NoError(t, err)
+	require.Equal(t, channel.ChannelID, decrypted.ChannelID)
+	require.Equal(t, channel.EncryptionKey, decrypted.EncryptionKey)
+	require.Equal(t, channel.AuthenticationKey, decrypted.AuthenticationKey)
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relay
+
+import (
+	"crypto/rand"
+
+	"github.com/google/uuid"
+
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// NewRandomChannel generates a fresh relay Channel with random 32-byte encryption and
+// authentication keys and a random UUID channel id, for bootstrapping a new mobile
+// pairing.
+func NewRandomChannel() (*Channel, error) {
+	encryptionKey := make([]byte, 32)
+	if _, err := rand.Read(encryptionKey); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	authenticationKey := make([]byte, 32)
+	if _, err := rand.Read(authenticationKey); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return NewChannel(uuid.New().String(), encryptionKey, authenticationKey), nil
+}
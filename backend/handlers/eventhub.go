@@ -0,0 +1,264 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// subscriberBufferSize is how many events a single subscriber can be behind before
+// EventHub starts dropping its oldest buffered events instead of blocking delivery to
+// every other subscriber.
+const subscriberBufferSize = 256
+
+// eventRingBufferSize is how many past events EventHub keeps around so a reconnecting
+// subscriber can request ?since=N and receive whatever it missed.
+const eventRingBufferSize = 1024
+
+// EventHub owns the single backend event channel and multiplexes it to any number of
+// subscribers (browser tabs, paired mobile clients over relay), each with its own
+// bounded, topic-filtered buffer so one slow reader cannot stall the others.
+type EventHub struct {
+	log *logrus.Entry
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+
+	history *eventRingBuffer
+}
+
+// NewEventHub creates an EventHub that relays events from backendEvents until
+// backendEvents is closed, at which point every subscriber is closed too.
+func NewEventHub(backendEvents <-chan interface{}, log *logrus.Entry) *EventHub {
+	hub := &EventHub{
+		log:         log,
+		subscribers: map[*eventSubscriber]struct{}{},
+		history:     newEventRingBuffer(eventRingBufferSize),
+	}
+	go hub.pump(backendEvents)
+	return hub
+}
+
+func (hub *EventHub) pump(backendEvents <-chan interface{}) {
+	for event := range backendEvents {
+		seq := hub.history.push(event)
+		hub.broadcast(seq, event)
+	}
+	hub.Close()
+}
+
+func (hub *EventHub) broadcast(seq uint64, event interface{}) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for sub := range hub.subscribers {
+		sub.send(seq, event)
+	}
+}
+
+// Publish injects event directly into the hub, as though it had arrived on the backend
+// event channel. Used by subsystems that originate events outside that channel, e.g.
+// bitbox device pairing status changes.
+func (hub *EventHub) Publish(event interface{}) {
+	seq := hub.history.push(event)
+	hub.broadcast(seq, event)
+}
+
+// Subscribe registers a new subscriber filtered by topics (empty means all topics) and
+// immediately replays any still-buffered events after sequence number since (0 means
+// none), so a reconnecting client does not miss events that happened while it was
+// disconnected.
+func (hub *EventHub) Subscribe(topics []string, since uint64) *eventSubscriber {
+	sub := newEventSubscriber(topics, hub.log)
+
+	hub.mu.Lock()
+	hub.subscribers[sub] = struct{}{}
+	hub.mu.Unlock()
+
+	// since==0 means "no replay" (a brand-new, non-reconnecting client): sequence
+	// numbers start at 1, so passing 0 straight to history.since would otherwise match
+	// every event still in the ring buffer.
+	if since != 0 {
+		for _, buffered := range hub.history.since(since) {
+			sub.send(buffered.seq, buffered.event)
+		}
+	}
+	return sub
+}
+
+// Unsubscribe removes sub from the hub and closes its event channel.
+func (hub *EventHub) Unsubscribe(sub *eventSubscriber) {
+	hub.mu.Lock()
+	_, ok := hub.subscribers[sub]
+	delete(hub.subscribers, sub)
+	hub.mu.Unlock()
+	if ok {
+		sub.close()
+	}
+}
+
+// Close closes every current subscriber. Registered as an api.API shutdown hook so
+// open websocket clients are told to disconnect instead of being left to time out.
+func (hub *EventHub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for sub := range hub.subscribers {
+		sub.close()
+	}
+	hub.subscribers = map[*eventSubscriber]struct{}{}
+}
+
+// eventEnvelope is what subscribers actually receive: the event itself tagged with the
+// sequence number it was broadcast at, so a client can persist the last seq it saw and
+// resume from there with ?since= after a reconnect.
+type eventEnvelope struct {
+	Seq   uint64      `json:"seq"`
+	Event interface{} `json:"event"`
+}
+
+// topicEvent is implemented by backend events that can be filtered by topic (e.g.
+// "wallet", "device", "rates"). Events that don't implement it are always delivered,
+// regardless of a subscriber's topic filter.
+type topicEvent interface {
+	Topic() string
+}
+
+// eventSubscriber is one client's view of the EventHub: a bounded, topic-filtered
+// channel with a drop-oldest policy, so a slow client falling behind cannot stall
+// delivery to anyone else.
+type eventSubscriber struct {
+	topics map[string]bool // nil means "all topics"
+	out    chan eventEnvelope
+	log    *logrus.Entry
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newEventSubscriber(topics []string, log *logrus.Entry) *eventSubscriber {
+	var topicSet map[string]bool
+	if len(topics) > 0 {
+		topicSet = map[string]bool{}
+		for _, topic := range topics {
+			topicSet[strings.TrimSpace(topic)] = true
+		}
+	}
+	return &eventSubscriber{
+		topics: topicSet,
+		out:    make(chan eventEnvelope, subscriberBufferSize),
+		log:    log,
+	}
+}
+
+// Events returns the channel new events are delivered on. It is closed when the
+// subscriber is unsubscribed or the hub shuts down.
+func (sub *eventSubscriber) Events() <-chan eventEnvelope {
+	return sub.out
+}
+
+func (sub *eventSubscriber) accepts(event interface{}) bool {
+	if sub.topics == nil {
+		return true
+	}
+	topical, ok := event.(topicEvent)
+	if !ok {
+		return true
+	}
+	return sub.topics[topical.Topic()]
+}
+
+func (sub *eventSubscriber) send(seq uint64, event interface{}) {
+	if !sub.accepts(event) {
+		return
+	}
+	envelope := eventEnvelope{Seq: seq, Event: event}
+	select {
+	case sub.out <- envelope:
+	default:
+		// The subscriber is falling behind: drop the oldest buffered event to make room
+		// rather than blocking the hub, which would stall delivery to every other
+		// subscriber.
+		select {
+		case <-sub.out:
+		default:
+		}
+		select {
+		case sub.out <- envelope:
+		default:
+		}
+		sub.log.Warn("websocket client is falling behind; dropped its oldest buffered event")
+	}
+}
+
+func (sub *eventSubscriber) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.out)
+}
+
+// bufferedEvent is one entry in an eventRingBuffer.
+type bufferedEvent struct {
+	seq   uint64
+	event interface{}
+}
+
+// eventRingBuffer remembers the last size events, with sequence numbers, so a
+// reconnecting subscriber can request ?since=N and receive whatever it missed.
+type eventRingBuffer struct {
+	mu      sync.Mutex
+	events  []bufferedEvent
+	nextSeq uint64
+	size    int
+}
+
+func newEventRingBuffer(size int) *eventRingBuffer {
+	return &eventRingBuffer{size: size}
+}
+
+// push appends event, evicting the oldest entry if the buffer is full, and returns the
+// sequence number it was assigned.
+func (buf *eventRingBuffer) push(event interface{}) uint64 {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	buf.nextSeq++
+	seq := buf.nextSeq
+	buf.events = append(buf.events, bufferedEvent{seq: seq, event: event})
+	if len(buf.events) > buf.size {
+		buf.events = buf.events[len(buf.events)-buf.size:]
+	}
+	return seq
+}
+
+// since returns the buffered events with a sequence number greater than seq, oldest
+// first. Events evicted from the buffer before they could be requested are not
+// returned; the caller just misses them, the same as before this ring buffer existed.
+func (buf *eventRingBuffer) since(seq uint64) []bufferedEvent {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	result := make([]bufferedEvent, 0, len(buf.events))
+	for _, event := range buf.events {
+		if event.seq > seq {
+			result = append(result, event)
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventSubscriberDropsOldestWhenFull(t *testing.T) {
+	sub := newEventSubscriber(nil, logrus.NewEntry(logrus.New()))
+
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		sub.send(uint64(i+1), i)
+	}
+
+	require.Len(t, sub.out, subscriberBufferSize, "the buffer must not grow past its bound")
+	first := <-sub.out
+	require.Equal(t, 10, first.Event, "the oldest entries should have been dropped to make room for the newest")
+}
+
+func TestEventSubscriberFiltersByTopic(t *testing.T) {
+	sub := newEventSubscriber([]string{"pairing"}, logrus.NewEntry(logrus.New()))
+
+	sub.send(1, pairingTestEvent{topic: "wallet"})
+	sub.send(2, pairingTestEvent{topic: "pairing"})
+
+	require.Len(t, sub.out, 1)
+	envelope := <-sub.out
+	require.Equal(t, uint64(2), envelope.Seq)
+}
+
+type pairingTestEvent struct {
+	topic string
+}
+
+func (e pairingTestEvent) Topic() string { return e.topic }
+
+func TestEventHubPublishBroadcastsToSubscribers(t *testing.T) {
+	hub := NewEventHub(make(chan interface{}), logrus.NewEntry(logrus.New()))
+	defer hub.Close()
+
+	sub := hub.Subscribe(nil, 0)
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish("hello")
+
+	envelope := <-sub.Events()
+	require.Equal(t, "hello", envelope.Event)
+}
+
+func TestEventHubSubscribeReplaysSince(t *testing.T) {
+	hub := NewEventHub(make(chan interface{}), logrus.NewEntry(logrus.New()))
+	defer hub.Close()
+
+	hub.Publish("first")
+	hub.Publish("second")
+
+	sub := hub.Subscribe(nil, 1)
+	defer hub.Unsubscribe(sub)
+
+	envelope := <-sub.Events()
+	require.Equal(t, "second", envelope.Event, "a subscriber with since=1 should only receive events after seq 1")
+}
+
+func TestEventHubSubscribeWithZeroSinceReplaysNothing(t *testing.T) {
+	hub := NewEventHub(make(chan interface{}), logrus.NewEntry(logrus.New()))
+	defer hub.Close()
+
+	hub.Publish("first")
+	hub.Publish("second")
+
+	sub := hub.Subscribe(nil, 0)
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish("third")
+
+	envelope := <-sub.Events()
+	require.Equal(t, "third", envelope.Event,
+		"since=0 means no replay: a fresh, non-reconnecting client must only see events published after it subscribed")
+	require.Len(t, sub.out, 0)
+}
+
+func TestEventHubCloseClosesSubscriberChannels(t *testing.T) {
+	hub := NewEventHub(make(chan interface{}), logrus.NewEntry(logrus.New()))
+	sub := hub.Subscribe(nil, 0)
+
+	hub.Close()
+
+	_, ok := <-sub.Events()
+	require.False(t, ok, "Close must close every subscriber's event channel")
+}
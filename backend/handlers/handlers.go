@@ -2,19 +2,22 @@ package handlers
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
-	qrcode "github.com/skip2/go-qrcode"
 	"golang.org/x/text/language"
 
 	"github.com/shiftdevices/godbb/backend"
+	"github.com/shiftdevices/godbb/backend/api"
+	"github.com/shiftdevices/godbb/backend/apierror"
+	"github.com/shiftdevices/godbb/backend/auth"
 	"github.com/shiftdevices/godbb/backend/coins/btc"
 	accountHandlers "github.com/shiftdevices/godbb/backend/coins/btc/handlers"
 	"github.com/shiftdevices/godbb/backend/coins/coin"
@@ -25,9 +28,9 @@ import (
 	"github.com/shiftdevices/godbb/backend/keystore"
 	"github.com/shiftdevices/godbb/backend/keystore/software"
 	"github.com/shiftdevices/godbb/util/errp"
-	"github.com/shiftdevices/godbb/util/jsonp"
 	"github.com/shiftdevices/godbb/util/locker"
 	"github.com/shiftdevices/godbb/util/logging"
+	"github.com/shiftdevices/godbb/util/qr"
 	"github.com/shiftdevices/godbb/util/system"
 )
 
@@ -60,8 +63,9 @@ type Handlers struct {
 	// backend to secure the API call. The data is fed into the static javascript app
 	// that is served, so the client knows where and how to connect to.
 	apiData           *ConnectionData
-	backendEvents     <-chan interface{}
+	eventHub          *EventHub
 	websocketUpgrader websocket.Upgrader
+	tokenService      *auth.TokenService
 	log               *logrus.Entry
 }
 
@@ -70,6 +74,9 @@ type ConnectionData struct {
 	port    int
 	token   string
 	devMode bool
+	// certPEM is the PEM-encoded self-signed certificate the API is served over, if
+	// any, pinned here so the bundled UI can trust it. See SetCertPEM.
+	certPEM []byte
 }
 
 // NewConnectionData creates a connection data struct which holds the port and token for the API.
@@ -82,20 +89,37 @@ func NewConnectionData(port int, token string) *ConnectionData {
 	}
 }
 
+// SetCertPEM pins the API's self-signed TLS certificate (as returned by api.API.Start)
+// into the connection data, so it gets interpolated into bundle.js as CERT_PEM and the
+// bundled UI can trust it instead of failing on an unknown certificate authority.
+func (connectionData *ConnectionData) SetCertPEM(certPEM []byte) {
+	connectionData.certPEM = certPEM
+}
+
 func (connectionData *ConnectionData) isDev() bool {
 	return connectionData.port == -1 || connectionData.token == ""
 }
 
-// NewHandlers creates a new Handlers instance.
+// NewHandlers creates a new Handlers instance, registering its routes on theAPI's
+// router instead of owning a router itself. This lets theAPI apply its own middleware
+// chain (TLS termination, CORS, gzip, logging, panic recovery, ...) uniformly, and lets
+// other subsystems register subrouters on the same API. theAPI is accepted as an
+// api.Registry rather than the concrete *api.API so this assembly code stays testable
+// against a fake.
 func NewHandlers(
 	backend Backend,
 	connData *ConnectionData,
+	theAPI api.Registry,
 ) *Handlers {
 	log := logging.Get().WithGroup("handlers")
-	router := mux.NewRouter()
+
+	tokenService, err := auth.NewTokenService()
+	if err != nil {
+		log.WithError(err).Fatal("failed to initialize the API token service")
+	}
 
 	handlers := &Handlers{
-		Router:  router,
+		Router:  theAPI.Router(),
 		backend: backend,
 		apiData: connData,
 		websocketUpgrader: websocket.Upgrader{
@@ -103,17 +127,21 @@ func NewHandlers(
 			WriteBufferSize: 1024,
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
-		log: logging.Get().WithGroup("handlers"),
+		tokenService: tokenService,
+		log:          logging.Get().WithGroup("handlers"),
 	}
 
 	getAPIRouter := func(subrouter *mux.Router) func(string, func(*http.Request) (interface{}, error)) *mux.Route {
 		return func(path string, f func(*http.Request) (interface{}, error)) *mux.Route {
 			return subrouter.Handle(path, ensureAPITokenValid(apiMiddleware(connData.isDev(), f),
-				connData, log))
+				handlers, log))
 		}
 	}
 
-	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter := theAPI.Subrouter("/api")
+	apiRouter.Handle("/login", apiMiddleware(connData.isDev(), handlers.postLoginHandler)).Methods("POST")
+	getAPIRouter(apiRouter)("/refresh", handlers.postRefreshHandler).Methods("POST")
+	getAPIRouter(apiRouter)("/logout", handlers.postLogoutHandler).Methods("POST")
 	getAPIRouter(apiRouter)("/qr", handlers.getQRCodeHandler).Methods("GET")
 	getAPIRouter(apiRouter)("/config", handlers.getConfigHandler).Methods("GET")
 	getAPIRouter(apiRouter)("/config", handlers.postConfigHandler).Methods("POST")
@@ -158,7 +186,7 @@ func NewHandlers(
 		if _, ok := deviceHandlersMap[deviceID]; !ok {
 			deviceHandlersMap[deviceID] = bitboxHandlers.NewHandlers(getAPIRouter(
 				apiRouter.PathPrefix(fmt.Sprintf("/devices/%s", deviceID)).Subrouter(),
-			), log)
+			), backend.Config(), handlers.eventHub.Publish, log)
 		}
 		return deviceHandlersMap[deviceID]
 	}
@@ -169,9 +197,13 @@ func NewHandlers(
 		getDeviceHandlers(deviceID).Uninit()
 	})
 
-	apiRouter.HandleFunc("/events", handlers.eventsHandler)
+	apiRouter.Handle("/events", ensureAPITokenValid(http.HandlerFunc(handlers.eventsHandler), handlers, log))
 
-	handlers.backendEvents = backend.Start()
+	handlers.eventHub = NewEventHub(backend.Start(), log)
+	theAPI.AddShutdownHook(handlers.eventHub.Close)
+	// backend.Start() has returned, so half-initialized backend state is no longer a
+	// concern: let requests queued behind the API's ready-gate through.
+	theAPI.MarkReady()
 
 	return handlers
 }
@@ -182,6 +214,7 @@ func (handlers *Handlers) interpolateConstants(body []byte) []byte {
 	}{
 		{"API_PORT", fmt.Sprintf("%d", handlers.apiData.port)},
 		{"API_TOKEN", fmt.Sprintf("%s", handlers.apiData.token)},
+		{"CERT_PEM", string(handlers.apiData.certPEM)},
 		{"LANG", handlers.backend.UserLanguage().String()},
 	} {
 		body = bytes.Replace(body, []byte(fmt.Sprintf("{{ %s }}", info.key)), []byte(info.value), -1)
@@ -196,28 +229,71 @@ func writeJSON(w http.ResponseWriter, value interface{}) {
 }
 
 func (handlers *Handlers) getQRCodeHandler(r *http.Request) (interface{}, error) {
-	data := r.URL.Query().Get("data")
-	qr, err := qrcode.New(data, qrcode.Medium)
-	if err != nil {
+	return qr.PNGDataURI(r.URL.Query().Get("data"))
+}
+
+// postLoginHandler trades the bootstrap token injected into bundle.js for a short-lived
+// JWT. The bootstrap token itself is never accepted by any other endpoint.
+func (handlers *Handlers) postLoginHandler(r *http.Request) (interface{}, error) {
+	jsonBody := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&jsonBody); err != nil {
 		return nil, errp.WithStack(err)
 	}
-	bytes, err := qr.PNG(256)
+	if !handlers.apiData.isDev() && jsonBody["token"] != handlers.apiData.token {
+		return nil, errp.New("invalid bootstrap token")
+	}
+	return handlers.tokenService.Issue("ui")
+}
+
+// postRefreshHandler exchanges a still-valid JWT for a new one, revoking the old one so
+// it cannot be replayed.
+func (handlers *Handlers) postRefreshHandler(r *http.Request) (interface{}, error) {
+	return handlers.tokenService.Refresh(bearerToken(r))
+}
+
+// postLogoutHandler revokes the caller's JWT so that browser can no longer use the API,
+// without affecting tokens issued to other clients.
+func (handlers *Handlers) postLogoutHandler(r *http.Request) (interface{}, error) {
+	claims, err := handlers.tokenService.Parse(bearerToken(r))
 	if err != nil {
-		return nil, errp.WithStack(err)
+		return nil, err
 	}
-	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(bytes), nil
+	handlers.tokenService.Revoke(claims.ID)
+	return true, nil
+}
+
+// configWithFingerprint pairs an AppConfig with the fingerprint it was read at (or, on
+// the way back from the UI, the fingerprint it was edited against), so concurrent
+// editors of the config can be detected instead of the last writer silently winning.
+type configWithFingerprint struct {
+	Config      config.AppConfig `json:"config"`
+	Fingerprint string           `json:"fingerprint"`
 }
 
 func (handlers *Handlers) getConfigHandler(_ *http.Request) (interface{}, error) {
-	return handlers.backend.Config().Config(), nil
+	fingerprint, err := handlers.backend.Config().Fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	return NewSuccessResponse(configWithFingerprint{
+		Config:      handlers.backend.Config().Config(),
+		Fingerprint: fingerprint,
+	}), nil
 }
 
 func (handlers *Handlers) postConfigHandler(r *http.Request) (interface{}, error) {
-	appConfig := config.AppConfig{}
-	if err := json.NewDecoder(r.Body).Decode(&appConfig); err != nil {
+	body := configWithFingerprint{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		return nil, errp.WithStack(err)
 	}
-	return nil, handlers.backend.Config().Set(appConfig)
+	err := handlers.backend.Config().DoLockedAction(body.Fingerprint, func(appConfig *config.AppConfig) error {
+		*appConfig = body.Config
+		return nil
+	})
+	if err := apierror.WrapConfigConflict(err); err != nil {
+		return nil, err
+	}
+	return NewSuccessResponse(nil), nil
 }
 
 func (handlers *Handlers) postOpenHandler(r *http.Request) (interface{}, error) {
@@ -237,7 +313,7 @@ func (handlers *Handlers) getTestingHandler(_ *http.Request) (interface{}, error
 }
 
 func (handlers *Handlers) getWalletsHandler(_ *http.Request) (interface{}, error) {
-	return handlers.backend.Accounts(), nil
+	return NewSuccessResponse(handlers.backend.Accounts()), nil
 }
 
 func (handlers *Handlers) getWalletStatusHandler(_ *http.Request) (interface{}, error) {
@@ -261,6 +337,9 @@ func (handlers *Handlers) registerTestKeyStoreHandler(r *http.Request) (interfac
 }
 
 func (handlers *Handlers) deregisterTestKeyStoreHandler(_ *http.Request) (interface{}, error) {
+	if handlers.backend.Keystores().Count() == 0 {
+		return nil, apierror.New(apierror.CodeKeystoreNotRegistered, "no keystore is registered")
+	}
 	handlers.backend.DeregisterKeystore()
 	return true, nil
 }
@@ -269,47 +348,73 @@ func (handlers *Handlers) getBtcRatesHandler(_ *http.Request) (interface{}, erro
 	return handlers.backend.Rates(), nil
 }
 
+// eventsHandler upgrades the connection and subscribes it to handlers.eventHub, which
+// fans the single backend event stream out to every connected client (browser tabs and
+// paired mobile clients alike) without one slow reader stalling the others.
 func (handlers *Handlers) eventsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := handlers.websocketUpgrader.Upgrade(w, r, nil)
+	// Browsers cannot set an Authorization header on WebSocket, so the JWT travels as
+	// the Sec-WebSocket-Protocol instead (see bearerToken). gorilla only echoes a
+	// subprotocol back in the 101 response when it appears in responseHeader (since
+	// Upgrader.Subprotocols is unset, there's no fixed list to negotiate against); if we
+	// don't echo it, the browser fails the handshake even though the server accepted it.
+	var responseHeader http.Header
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+	}
+	conn, err := handlers.websocketUpgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		panic(err)
+		handlers.log.WithError(err).Error("failed to upgrade to websocket")
+		return
 	}
 
-	sendChan, quitChan := runWebsocket(conn, handlers.apiData, handlers.log)
-	go func() {
-		for {
-			select {
-			case <-quitChan:
-				return
-			default:
-				select {
-				case <-quitChan:
-					return
-				case event := <-handlers.backendEvents:
-					sendChan <- jsonp.MustMarshal(event)
-				}
-			}
+	var topics []string
+	if raw := r.URL.Query().Get("topics"); raw != "" {
+		topics = strings.Split(raw, ",")
+	}
+	var since uint64
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		if parsed, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			since = parsed
 		}
-	}()
+	}
+
+	sub := handlers.eventHub.Subscribe(topics, since)
+	go serveEventSubscriber(conn, handlers.eventHub, sub, handlers.log)
+}
+
+// bearerToken extracts the JWT from the request. Regular API calls carry it in the
+// Authorization header; the events websocket carries it either as the
+// Sec-WebSocket-Protocol (browsers cannot set custom headers on WebSocket) or, failing
+// that, as a "token" query parameter.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if protocol := r.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		return strings.TrimSpace(protocol)
+	}
+	return r.URL.Query().Get("token")
 }
 
 // isAPITokenValid checks whether we are in dev or prod mode and, if we are in prod mode, verifies
-// that an authorization token is received as an HTTP Authorization header and that it is valid.
-func isAPITokenValid(w http.ResponseWriter, r *http.Request, apiData *ConnectionData, log *logrus.Entry) bool {
+// that a valid, non-expired, non-revoked JWT is received with the request.
+func isAPITokenValid(w http.ResponseWriter, r *http.Request, handlers *Handlers, log *logrus.Entry) bool {
 	methodLogEntry := log.WithField("path", r.URL.Path)
 	// In dev mode, we allow unauthorized requests
-	if apiData.devMode {
+	if handlers.apiData.devMode {
 		// methodLogEntry.Debug("Allowing access without authorization token in dev mode")
 		return true
 	}
 	methodLogEntry.Debug("Checking API token")
 
-	if len(r.Header.Get("Authorization")) == 0 {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
 		methodLogEntry.Error("Missing token in API request. WARNING: this could be an attack on the API")
 		http.Error(w, "missing token "+r.URL.Path, http.StatusUnauthorized)
 		return false
-	} else if len(r.Header.Get("Authorization")) != 0 && r.Header.Get("Authorization") != "Basic "+apiData.token {
-		methodLogEntry.Error("Incorrect token in API request. WARNING: this could be an attack on the API")
+	}
+	if _, err := handlers.tokenService.Parse(tokenString); err != nil {
+		methodLogEntry.WithError(err).Error("Incorrect token in API request. WARNING: this could be an attack on the API")
 		http.Error(w, "incorrect token", http.StatusUnauthorized)
 		return false
 	}
@@ -329,14 +434,18 @@ func ensureNoCacheForBundleJS(h http.Handler) http.Handler {
 }
 
 // ensureAPITokenValid wraps the given handler with another handler function that calls isAPITokenValid().
-func ensureAPITokenValid(h http.Handler, apiData *ConnectionData, log *logrus.Entry) http.Handler {
+func ensureAPITokenValid(h http.Handler, handlers *Handlers, log *logrus.Entry) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if isAPITokenValid(w, r, apiData, log) {
+		if isAPITokenValid(w, r, handlers, log) {
 			h.ServeHTTP(w, r)
 		}
 	})
 }
 
+// apiMiddleware wraps a handler's (interface{}, error) result in a Response envelope so
+// clients can distinguish success from failure and read a structured error code. A
+// handler that already returns a *Response (e.g. because it needs to set Code itself)
+// is passed through unchanged.
 func apiMiddleware(devMode bool, h func(*http.Request) (interface{}, error)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/json")
@@ -347,9 +456,14 @@ func apiMiddleware(devMode bool, h func(*http.Request) (interface{}, error)) htt
 		}
 		value, err := h(r)
 		if err != nil {
-			writeJSON(w, map[string]string{"error": err.Error()})
+			w.WriteHeader(httpStatus(err))
+			writeJSON(w, NewErrorResponse(err))
+			return
+		}
+		if response, ok := value.(*Response); ok {
+			writeJSON(w, response)
 			return
 		}
-		writeJSON(w, value)
+		writeJSON(w, NewSuccessResponse(value))
 	})
 }
@@ -0,0 +1,54 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/shiftdevices/godbb/backend/apierror"
+)
+
+// Response is the uniform envelope returned by the JSON API, so the frontend can
+// distinguish success from failure and access a structured error code instead of
+// string-sniffing the error message.
+type Response struct {
+	Status string      `json:"status"`
+	Code   string      `json:"code,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Msg    string      `json:"message,omitempty"`
+}
+
+// NewSuccessResponse wraps data in a successful Response.
+func NewSuccessResponse(data interface{}) *Response {
+	return &Response{Status: "success", Data: data}
+}
+
+// NewErrorResponse wraps err in a failed Response. If err is (or wraps) an
+// *apierror.Error, Code is populated from it; otherwise Code is apierror.CodeUnknown.
+func NewErrorResponse(err error) *Response {
+	if apiErr, ok := apierror.As(err); ok {
+		return &Response{Status: "fail", Code: apiErr.Code, Msg: apiErr.Message}
+	}
+	return &Response{Status: "fail", Code: apierror.CodeUnknown, Msg: err.Error()}
+}
+
+// httpStatus returns the HTTP status apiMiddleware should send for err.
+func httpStatus(err error) int {
+	if apiErr, ok := apierror.As(err); ok {
+		return apiErr.HTTPStatus()
+	}
+	return http.StatusInternalServerError
+}
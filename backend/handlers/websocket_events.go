@@ -0,0 +1,84 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventWriteWait is how long a single write to the websocket may take before the
+	// connection is considered dead.
+	eventWriteWait = 10 * time.Second
+	// eventPongWait is how long we wait for a pong (or any client message) before
+	// considering the connection dead and closing it, so we don't leak goroutines on
+	// clients that disappeared without a clean close (e.g. a laptop going to sleep).
+	eventPongWait = 60 * time.Second
+	// eventPingPeriod must be shorter than eventPongWait so pings arrive in time to
+	// keep a healthy connection's deadline pushed out.
+	eventPingPeriod = (eventPongWait * 9) / 10
+)
+
+// serveEventSubscriber pumps events from sub to conn until either is closed, sending
+// periodic pings and closing conn if no pong (or any other client message) arrives
+// within eventPongWait.
+func serveEventSubscriber(conn *websocket.Conn, hub *EventHub, sub *eventSubscriber, log *logrus.Entry) {
+	defer func() {
+		hub.Unsubscribe(sub)
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(eventPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(eventPongWait))
+	})
+	// The events websocket is server-push only, but we still need to read from it to
+	// drive the pong handler and notice a dead connection via the read deadline above.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				hub.Unsubscribe(sub)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case envelope, ok := <-sub.Events():
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteJSON(envelope); err != nil {
+				log.WithError(err).Debug("failed to write event to websocket client")
+				return
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(eventWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2018 Shift Devices AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package qr renders QR codes as data URIs, shared by the /api/qr endpoint and the
+// bitbox mobile pairing handlers.
+package qr
+
+import (
+	"encoding/base64"
+
+	qrcode "github.com/skip2/go-qrcode"
+
+	"github.com/shiftdevices/godbb/util/errp"
+)
+
+// PNGDataURI renders data as a QR code and returns it as a "data:image/png;base64,..."
+// URI, suitable for direct use as an <img> src.
+func PNGDataURI(data string) (string, error) {
+	qr, err := qrcode.New(data, qrcode.Medium)
+	if err != nil {
+		return "", errp.WithStack(err)
+	}
+	png, err := qr.PNG(256)
+	if err != nil {
+		return "", errp.WithStack(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}